@@ -0,0 +1,23 @@
+// Package config holds the tunables that control how the proxy processes traffic.
+package config
+
+import "time"
+
+// HandleTimeout bounds how long a single Handler.Handle call is allowed to run before its context is
+// cancelled.
+const HandleTimeout = 5 * time.Second
+
+// Config groups the proxy-wide settings that are not specific to a single Serve call.
+type Config struct {
+	// UpstreamAddr is the address:port of the real game server traffic is proxied to.
+	UpstreamAddr string
+
+	// SessionIdleTimeout controls how long a per-client session may sit idle before its upstream
+	// connection is torn down and the session is pruned from the session table. Zero disables idle
+	// expiry.
+	SessionIdleTimeout time.Duration
+
+	// MaxSessions caps the number of concurrent per-client sessions the proxy will track. Zero means
+	// unlimited.
+	MaxSessions int
+}
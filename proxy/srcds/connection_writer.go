@@ -0,0 +1,42 @@
+package srcds
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnectionWriter is the ResponseWriter a Handler uses to send a reply back to a single client over
+// the shared listening connection.
+type ConnectionWriter struct {
+	ctx        context.Context
+	connection net.UDPConn
+	sourceAddr *net.UDPAddr
+
+	// writeMu is the Server's shared write mutex; the listening connection is written to concurrently
+	// and SetWriteDeadline applies to the whole socket, not a single call.
+	writeMu *sync.Mutex
+}
+
+// NewConnectionWriter creates a ConnectionWriter that writes to sourceAddr over connection. ctx should
+// be the same context passed to the backing Handler.Handle call, so its deadline bounds the write.
+// writeMu must be shared with every other writer created over the same connection.
+func NewConnectionWriter(ctx context.Context, connection net.UDPConn, sourceAddr *net.UDPAddr, writeMu *sync.Mutex) *ConnectionWriter {
+	return &ConnectionWriter{ctx: ctx, connection: connection, sourceAddr: sourceAddr, writeMu: writeMu}
+}
+
+// Write sends p to the client, honoring the deadline of the context the writer was created with.
+func (w *ConnectionWriter) Write(p []byte) (int, error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	if deadline, ok := w.ctx.Deadline(); ok {
+		if err := w.connection.SetWriteDeadline(deadline); err != nil {
+			return 0, err
+		}
+		defer w.connection.SetWriteDeadline(time.Time{})
+	}
+
+	return w.connection.WriteToUDP(p, w.sourceAddr)
+}
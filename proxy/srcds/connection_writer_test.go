@@ -0,0 +1,42 @@
+package srcds
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConnectionWriterAppliesAndResetsDeadline verifies Write applies the deadline of the context it
+// was constructed with to the underlying connection, and resets it afterward so an earlier expired
+// deadline cannot leak into a later write made with a context that carries none.
+func TestConnectionWriterAppliesAndResetsDeadline(t *testing.T) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer server.Close()
+
+	client, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+
+	var writeMu sync.Mutex
+
+	expiredCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	expired := NewConnectionWriter(expiredCtx, *server, clientAddr, &writeMu)
+	if _, err := expired.Write([]byte("late")); err == nil {
+		t.Fatal("Write with an already-expired context deadline succeeded, want a deadline-exceeded error")
+	}
+
+	live := NewConnectionWriter(context.Background(), *server, clientAddr, &writeMu)
+	if _, err := live.Write([]byte("ok")); err != nil {
+		t.Fatalf("Write with no deadline failed right after an expired write: %v (deadline was not reset)", err)
+	}
+}
@@ -1,11 +1,13 @@
 package srcds
 
 import (
-	"net"
 	"context"
-	"srcds_proxy/proxy/config"
-	"time"
 	"log"
+	"net"
+	"sync"
+	"time"
+
+	"srcds_proxy/proxy/config"
 )
 
 func Dial(addr string) (*net.UDPConn, error) {
@@ -46,75 +48,248 @@ func Listen(addr string) (*net.UDPConn, error) {
 	return connection, nil
 }
 
-func Serve(done <-chan struct{}, connection net.UDPConn, handler Handler, timeout time.Duration) error {
-	// Serve will read data from a the connection to a buffer and call the handler provided.
-	var (
-		n          int
-		sourceAddr *net.UDPAddr
-		err        error
-		buf        = make([]byte, MaxDatagramSize)
-		timer      *time.Timer // destruction timer, when it triggers, stop the Serve function.
-	)
+// aLongTimeAgo is a past read deadline used to unblock a pending ReadFromUDP without closing the socket.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// packetChannelSize bounds how far the reader goroutine can read ahead of the dispatcher.
+const packetChannelSize = 128
+
+// defaultCloseChBuffer sizes closeCh when cfg.MaxSessions is unbounded. 1x the expected concurrent
+// session count is enough because Session.Close is idempotent: it enqueues on closeCh at most once no
+// matter how many times it's called, so a burst of simultaneous idle expiries can't double up.
+const defaultCloseChBuffer = 1024
+
+// sessionPacket is a single datagram read off the listening socket, handed from the reader goroutine to
+// the session dispatcher over a channel.
+type sessionPacket struct {
+	buf        []byte
+	n          int
+	sourceAddr *net.UDPAddr
+	err        error
+}
+
+// ServeOptions configures a single Server's handler dispatch budget, scoped per call rather than
+// process-wide like config.HandleTimeout.
+type ServeOptions struct {
+	// HandleTimeout bounds how long a single Handler.Handle call may run. Zero falls back to
+	// config.HandleTimeout.
+	HandleTimeout time.Duration
+}
+
+// Server serves one listening UDP connection, dispatching datagrams to per-client sessions. Use
+// NewServer to construct one and Shutdown to drain it.
+type Server struct {
+	connection net.UDPConn
+	handler    Handler
+	cfg        config.Config
+	opts       ServeOptions
+
+	shutdown chan struct{}
+	loopDone chan struct{} // closed by Serve when its loop returns; Shutdown waits on this before touching sessions.
+	wg       sync.WaitGroup
+
+	sessions map[string]*Session
+	closeCh  chan string
+
+	queue       chan *packetJob // unbuffered: a send only succeeds when a worker is parked on <-queue.
+	backlog     chan *packetJob // buffered overflow used once the worker pool is at maxIdleWorkers.
+	workerCount int32
+
+	// workerIdleTimeout overrides defaultIdleWorkerTimeout when set; tests use this to avoid waiting
+	// out the real timeout. Zero means "use the default".
+	workerIdleTimeout time.Duration
 
-	if timeout > 0 {
-		timer = time.NewTimer(timeout)
-		go func() {
-			<-timer.C
-			connection.Close()
-		}()
+	writeMu sync.Mutex // serializes writes to the shared listening connection across workers.
+}
+
+// NewServer creates a Server ready to be run with Serve.
+func NewServer(connection net.UDPConn, handler Handler, cfg config.Config, opts ServeOptions) *Server {
+	// closeChBuffer holds one pending notification per tracked session; see defaultCloseChBuffer for
+	// why 1x is enough.
+	closeChBuffer := cfg.MaxSessions
+	if closeChBuffer <= 0 {
+		closeChBuffer = defaultCloseChBuffer
 	}
 
-	for {
-		// Read into buffer.
-		n, sourceAddr, err = connection.ReadFromUDP(buf)
+	return &Server{
+		connection: connection,
+		handler:    handler,
+		cfg:        cfg,
+		opts:       opts,
+		shutdown:   make(chan struct{}),
+		loopDone:   make(chan struct{}),
+		sessions:   make(map[string]*Session),
+		closeCh:    make(chan string, closeChBuffer),
+		queue:      make(chan *packetJob),
+		backlog:    make(chan *packetJob, queueSize),
+	}
+}
+
+// handleTimeout returns the per-call handler budget, falling back to config.HandleTimeout when the
+// server was not given an explicit one.
+func (srv *Server) handleTimeout() time.Duration {
+	if srv.opts.HandleTimeout > 0 {
+		return srv.opts.HandleTimeout
+	}
+	return config.HandleTimeout
+}
+
+// Serve dispatches datagrams to per-client sessions until Shutdown is called or a read error occurs.
+// Serve is the sole owner of srv.sessions: it is the only goroutine that creates or prunes entries
+// (a session may still close itself from its idle timer or read pump), so Shutdown must wait for this loop to return (via loopDone) before it is safe to assume
+// no session is still being created or torn down.
+func (srv *Server) Serve() error {
+	packets := make(chan sessionPacket, packetChannelSize)
+	go readPackets(srv.connection, srv.shutdown, packets)
 
-		// When a done event is emitted, exit without handling the message.
-		// When the done event is emitted, the connection is also terminated. Thus ReadFromUDP immediately stop with an
-		// error but before actually checking the error, we check that the task is not done. So basically, when there is
-		// a "done" event, Serve immediately stops.
+	defer close(srv.loopDone)
+
+	for {
 		select {
-		case <-done:
+		case <-srv.shutdown:
+			srv.closeSessions()
 			return nil
-		default:
+		case key := <-srv.closeCh:
+			delete(srv.sessions, key)
+		case pkt := <-packets:
+			if pkt.err != nil {
+				GetBufferPool().Put(pkt.buf)
+				srv.closeSessions()
+				return pkt.err
+			}
+
+			if err := srv.dispatch(pkt); err != nil {
+				srv.closeSessions()
+				return err
+			}
 		}
+	}
+}
 
-		// If there is a valid message received, reset the destruction timer. If the timer has expired, do not handle
-		// the message and return.
-		if timeout > 0 && !timer.Reset(timeout) {
-			log.Print("DEBUG: Stop Serve after timeout.")
-			return nil
+// closeSessions tears down every tracked session. Only Serve's loop goroutine may call this, since it
+// is the sole writer of srv.sessions.
+func (srv *Server) closeSessions() {
+	for _, session := range srv.sessions {
+		session.Close()
+	}
+}
+
+// Shutdown stops Serve and waits for in-flight handlers to drain before closing the connection. Session
+// teardown itself happens inside the Serve loop, not here.
+//
+// Serve's loop is the only goroutine that ever calls wg.Add (dispatch does so each time it enqueues a
+// packet's handler job), so Shutdown must wait for that loop to return before it starts
+// wg.Wait: calling Add concurrently with Wait is only safe once nothing can call Add again, and waiting
+// for loopDone first is what guarantees that.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	close(srv.shutdown)
+
+	if err := srv.connection.SetReadDeadline(aLongTimeAgo); err != nil {
+		return err
+	}
+
+	select {
+	case <-srv.loopDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return srv.connection.Close()
+}
+
+// readPackets owns the socket's read loop, pushing buffers from bufferPool onto packets. A read error
+// during shutdown is swallowed rather than reported.
+func readPackets(connection net.UDPConn, shutdown <-chan struct{}, packets chan<- sessionPacket) {
+	for {
+		buf := GetBufferPool().Get()
+		n, sourceAddr, err := connection.ReadFromUDP(buf)
+
+		if err != nil {
+			select {
+			case <-shutdown:
+				GetBufferPool().Put(buf)
+				return
+			default:
+			}
 		}
 
-		// Check for Read error.
+		packets <- sessionPacket{buf: buf, n: n, sourceAddr: sourceAddr, err: err}
 		if err != nil {
-			return err
+			return
 		}
+	}
+}
+
+// dispatch routes a single packet to its client's session, creating one the first time a client is
+// seen, forwards the packet upstream, and runs it through the existing Handler on a pool worker.
+func (srv *Server) dispatch(pkt sessionPacket) error {
+	key := pkt.sourceAddr.String()
 
-		if err := doHandle(done, buf[:n], connection, sourceAddr, handler); err != nil {
-			return err
+	session, ok := srv.sessions[key]
+	if !ok {
+		if srv.cfg.MaxSessions > 0 && len(srv.sessions) >= srv.cfg.MaxSessions {
+			log.Printf("DEBUG: dropping packet from %s, session table is full", key)
+			GetBufferPool().Put(pkt.buf)
+			return nil
 		}
+
+		var err error
+		session, err = newSession(key, pkt.sourceAddr, &srv.connection, srv.cfg.UpstreamAddr, srv.cfg.SessionIdleTimeout, srv.closeCh, &srv.writeMu)
+		if err != nil {
+			log.Printf("DEBUG: failed to open upstream session for %s: %v", key, err)
+			GetBufferPool().Put(pkt.buf)
+			return nil
+		}
+		srv.sessions[key] = session
+	}
+
+	if err := session.writeUpstream(pkt.buf[:pkt.n]); err != nil {
+		log.Printf("DEBUG: failed to forward packet from %s upstream: %v", key, err)
 	}
+
+	// Every packet also runs through the handler on a pool worker, matching the baseline behavior of
+	// calling Handler.Handle for every inbound datagram, so a slow handler cannot stall the read loop.
+	// The worker returns the buffer to bufferPool once it is done. wg is incremented here, at enqueue
+	// time, so Shutdown waits for queued jobs too, not just ones a worker has already picked up.
+	srv.wg.Add(1)
+	srv.spawnOrQueue(&packetJob{buf: pkt.buf, n: pkt.n, sourceAddr: pkt.sourceAddr})
+	return nil
 }
 
-func doHandle(done <-chan struct{}, buf []byte, connection net.UDPConn, sourceAddr *net.UDPAddr, handler Handler) error {
+func (srv *Server) doHandle(buf []byte, sourceAddr *net.UDPAddr) error {
 	if len(buf) == 0 {
 		return nil
 	}
 
-	// If done event is sent, cancel all requests processing.
-	ctx, cancelDone := context.WithCancel(context.Background())
+	// Handler has limited time to process the message.
+	ctx, cancel := context.WithTimeout(context.Background(), srv.handleTimeout())
+	defer cancel()
+
+	// Cancel the handler's context early if the server starts shutting down while it is in flight. ctx
+	// is never reassigned after this point, so the goroutine's read of it races with nothing.
 	go func() {
-		<-done
-		cancelDone()
+		select {
+		case <-srv.shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
 	}()
 
-	// Handler has limited time to process the message.
-	ctx, cancelTimeout := context.WithTimeout(ctx, config.HandleTimeout)
-	defer cancelTimeout()
-
 	msg := BytesToMessage(buf)
-	responseWriter := NewConnectionWriter(connection, sourceAddr)
-	return handler.Handle(ctx, responseWriter, msg, UDPAddrToAddressPort(*sourceAddr))
+	responseWriter := NewConnectionWriter(ctx, srv.connection, sourceAddr, &srv.writeMu)
+	return srv.handler.Handle(ctx, responseWriter, msg, UDPAddrToAddressPort(*sourceAddr))
 }
 
 func setSRCSConnectionOptions(connection *net.UDPConn) error {
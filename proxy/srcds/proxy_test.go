@@ -0,0 +1,229 @@
+package srcds
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"srcds_proxy/proxy/config"
+)
+
+// recordingHandler is a Handler stub that only needs to satisfy the interface for Serve to run; the
+// assertions in TestDispatchForwardsBothPacketsUpstream are made against the upstream socket, not
+// against handler invocations.
+type recordingHandler struct{}
+
+func (recordingHandler) Handle(ctx context.Context, w ResponseWriter, msg Message, addr AddressPort) error {
+	return nil
+}
+
+// TestDispatchForwardsBothPacketsUpstream reproduces a bug where the packet that created a session was
+// run through the Handler but never forwarded to the upstream game server, so only the client's second
+// and later packets ever reached it.
+func TestDispatchForwardsBothPacketsUpstream(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen upstream: %v", err)
+	}
+	defer upstream.Close()
+
+	listener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen proxy: %v", err)
+	}
+
+	cfg := config.Config{UpstreamAddr: upstream.LocalAddr().String()}
+	srv := NewServer(*listener, recordingHandler{}, cfg, ServeOptions{})
+
+	serveDone := make(chan error, 1)
+	go func() { serveDone <- srv.Serve() }()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		<-serveDone
+	}()
+
+	client, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("packet1")); err != nil {
+		t.Fatalf("write packet1: %v", err)
+	}
+	if _, err := client.Write([]byte("packet2")); err != nil {
+		t.Fatalf("write packet2: %v", err)
+	}
+
+	upstream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, MaxDatagramSize)
+
+	n, _, err := upstream.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("upstream never received the session-creating packet: %v", err)
+	}
+	if got := string(buf[:n]); got != "packet1" {
+		t.Fatalf("upstream's first packet was %q, want %q", got, "packet1")
+	}
+
+	n, _, err = upstream.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("upstream never received the second packet: %v", err)
+	}
+	if got := string(buf[:n]); got != "packet2" {
+		t.Fatalf("upstream's second packet was %q, want %q", got, "packet2")
+	}
+}
+
+// blockingHandler blocks on release until told to return, so a test can assert that Shutdown waits for
+// a handler still in flight rather than returning as soon as the read loop exits.
+type blockingHandler struct {
+	entered chan struct{}
+	release chan struct{}
+	done    int32
+}
+
+func (h *blockingHandler) Handle(ctx context.Context, w ResponseWriter, msg Message, addr AddressPort) error {
+	close(h.entered)
+	<-h.release
+	atomic.StoreInt32(&h.done, 1)
+	return nil
+}
+
+// TestShutdownWaitsForInFlightHandler reproduces a race where Shutdown returned (and closed the
+// connection) while a handler spawned for the session-creating packet was still running.
+func TestShutdownWaitsForInFlightHandler(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen upstream: %v", err)
+	}
+	defer upstream.Close()
+
+	listener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen proxy: %v", err)
+	}
+
+	handler := &blockingHandler{entered: make(chan struct{}), release: make(chan struct{})}
+	cfg := config.Config{UpstreamAddr: upstream.LocalAddr().String()}
+	srv := NewServer(*listener, handler, cfg, ServeOptions{})
+
+	serveDone := make(chan error, 1)
+	go func() { serveDone <- srv.Serve() }()
+
+	client, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("packet1")); err != nil {
+		t.Fatalf("write packet1: %v", err)
+	}
+
+	select {
+	case <-handler.entered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler was never invoked for the session-creating packet")
+	}
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdownDone <- srv.Shutdown(ctx)
+	}()
+
+	// Shutdown must still be blocked while the handler is in flight.
+	select {
+	case <-shutdownDone:
+		t.Fatal("Shutdown returned before the in-flight handler finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(handler.release)
+
+	if err := <-shutdownDone; err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	<-serveDone
+
+	if atomic.LoadInt32(&handler.done) != 1 {
+		t.Fatal("Shutdown returned without the handler having completed")
+	}
+}
+
+// countingHandler counts how many times Handle is invoked.
+type countingHandler struct {
+	calls int32
+}
+
+func (h *countingHandler) Handle(ctx context.Context, w ResponseWriter, msg Message, addr AddressPort) error {
+	atomic.AddInt32(&h.calls, 1)
+	return nil
+}
+
+// TestDispatchRunsHandlerForEveryPacket pins down that the Handler sees every inbound datagram for a
+// session, not just the one that created it -- matching the baseline Serve/doHandle contract.
+func TestDispatchRunsHandlerForEveryPacket(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen upstream: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			if _, _, err := upstream.ReadFromUDP(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	listener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen proxy: %v", err)
+	}
+
+	handler := &countingHandler{}
+	cfg := config.Config{UpstreamAddr: upstream.LocalAddr().String()}
+	srv := NewServer(*listener, handler, cfg, ServeOptions{})
+
+	serveDone := make(chan error, 1)
+	go func() { serveDone <- srv.Serve() }()
+
+	client, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer client.Close()
+
+	const packetCount = 5
+	for i := 0; i < packetCount; i++ {
+		if _, err := client.Write([]byte("packet")); err != nil {
+			t.Fatalf("write packet %d: %v", i, err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&handler.calls) < packetCount && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+	<-serveDone
+
+	if got := atomic.LoadInt32(&handler.calls); got != packetCount {
+		t.Fatalf("handler was called %d times, want %d (once per packet)", got, packetCount)
+	}
+}
@@ -0,0 +1,111 @@
+package srcds
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Session is a single downstream client's conversation, backed by its own dedicated upstream connection.
+type Session struct {
+	key        string
+	clientAddr *net.UDPAddr
+	downstream *net.UDPConn // the listening socket shared by all sessions, used to write back to the client.
+	upstream   *net.UDPConn // dedicated connection dialed to the real game server for this client only.
+
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+
+	closeCh chan<- string // notifies the dispatcher that this session's key should be pruned.
+	writeMu *sync.Mutex   // shared with the Server; downstream is the same socket ConnectionWriter uses.
+
+	closeOnce sync.Once // Close is triggered from both readPump and the idle timer; only enqueue once.
+}
+
+// newSession dials a dedicated upstream connection for addr and starts the session's read pump.
+func newSession(key string, clientAddr *net.UDPAddr, downstream *net.UDPConn, upstreamAddr string, idleTimeout time.Duration, closeCh chan<- string, writeMu *sync.Mutex) (*Session, error) {
+	upstream, err := Dial(upstreamAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		key:         key,
+		clientAddr:  clientAddr,
+		downstream:  downstream,
+		upstream:    upstream,
+		idleTimeout: idleTimeout,
+		closeCh:     closeCh,
+		writeMu:     writeMu,
+	}
+
+	if idleTimeout > 0 {
+		s.idleTimer = time.AfterFunc(idleTimeout, s.expire)
+	}
+
+	go s.readPump()
+
+	return s, nil
+}
+
+// writeUpstream forwards a downstream->upstream datagram over the session's dedicated connection and
+// resets the idle timer.
+func (s *Session) writeUpstream(buf []byte) error {
+	s.touch()
+	_, err := s.upstream.Write(buf)
+	return err
+}
+
+// touch resets the idle timer whenever the session observes traffic in either direction.
+func (s *Session) touch() {
+	if s.idleTimer != nil {
+		s.idleTimer.Reset(s.idleTimeout)
+	}
+}
+
+// expire runs when the idle timer fires with no traffic in either direction.
+func (s *Session) expire() {
+	s.Close()
+}
+
+// Close tears down the upstream connection and notifies the dispatcher so the session table entry is
+// pruned. It is safe to call more than once: both readPump (reacting to the upstream.Close below) and
+// the idle timer call this independently, but closeOnce ensures closeCh is only ever sent to once, so
+// a burst of simultaneous idle expiries can't fill it and silently drop a prune notification.
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		if s.idleTimer != nil {
+			s.idleTimer.Stop()
+		}
+		s.upstream.Close()
+		select {
+		case s.closeCh <- s.key:
+		default:
+		}
+	})
+}
+
+// readPump copies datagrams from the session's dedicated upstream connection back to the downstream
+// client for as long as the upstream connection stays healthy.
+func (s *Session) readPump() {
+	buf := GetBufferPool().Get()
+	defer GetBufferPool().Put(buf)
+
+	for {
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			s.Close()
+			return
+		}
+
+		s.touch()
+
+		s.writeMu.Lock()
+		_, err = s.downstream.WriteToUDP(buf[:n], s.clientAddr)
+		s.writeMu.Unlock()
+		if err != nil {
+			s.Close()
+			return
+		}
+	}
+}
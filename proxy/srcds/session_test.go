@@ -0,0 +1,55 @@
+package srcds
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSessionCloseIsIdempotent reproduces a bug where Close unconditionally re-sent on closeCh every
+// time it ran. Close is triggered twice in the ordinary teardown path -- the triggering call itself,
+// plus readPump reacting to the resulting upstream.Close() by calling Close again -- so a burst of
+// simultaneous idle expiries could fill a 1x-sized closeCh and silently drop a prune notification,
+// wedging that client's session forever. Close must enqueue on closeCh at most once.
+func TestSessionCloseIsIdempotent(t *testing.T) {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen upstream: %v", err)
+	}
+	defer upstream.Close()
+
+	listener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen proxy: %v", err)
+	}
+	defer listener.Close()
+
+	closeCh := make(chan string, 1)
+	var writeMu sync.Mutex
+	clientAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	s, err := newSession("client", clientAddr, listener, upstream.LocalAddr().String(), 500*time.Millisecond, closeCh, &writeMu)
+	if err != nil {
+		t.Fatalf("newSession: %v", err)
+	}
+
+	s.Close()
+
+	select {
+	case <-closeCh:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Close did not notify closeCh")
+	}
+
+	// closeCh's buffer is full at this point (capacity 1, nothing has drained it). If Close sent a
+	// second time -- from readPump reacting to upstream.Close(), or later from the idle timer --
+	// that send would silently drop, which is exactly the bug: the key would vanish and the session
+	// would never be pruned. Both of those triggers fire within idleTimeout, so waiting past it is
+	// enough to know neither tried to re-enqueue.
+	select {
+	case key := <-closeCh:
+		t.Fatalf("Close sent a second notification for %q; it must enqueue at most once", key)
+	case <-time.After(700 * time.Millisecond):
+	}
+}
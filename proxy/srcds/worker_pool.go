@@ -0,0 +1,83 @@
+package srcds
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// queueSize is how many pending packetJobs can sit on the backlog before spawnOrQueue starts
+	// blocking the caller.
+	queueSize = 128
+
+	// maxIdleWorkers caps how many persistent worker goroutines the pool keeps around at once.
+	maxIdleWorkers = 10000
+
+	// defaultIdleWorkerTimeout is how long a worker waits on the queue for its next job before it
+	// exits, when the Server was not given a more specific value.
+	defaultIdleWorkerTimeout = 10 * time.Second
+)
+
+// packetJob is a unit of handler work: one inbound packet, destined for doHandle on a pool worker
+// rather than the dispatch goroutine itself.
+type packetJob struct {
+	buf        []byte
+	n          int
+	sourceAddr *net.UDPAddr
+}
+
+// spawnOrQueue hands job to an idle worker if one is parked on the unbuffered queue, starts a new
+// worker if the pool has not reached maxIdleWorkers, and otherwise pushes onto the buffered backlog.
+func (srv *Server) spawnOrQueue(job *packetJob) {
+	select {
+	case srv.queue <- job:
+		return
+	default:
+	}
+
+	if atomic.AddInt32(&srv.workerCount, 1) <= maxIdleWorkers {
+		go srv.worker(job)
+		return
+	}
+	atomic.AddInt32(&srv.workerCount, -1)
+
+	srv.backlog <- job
+}
+
+// worker runs job and then keeps pulling jobs off queue or backlog until it has sat idle for
+// srv.idleWorkerTimeout, at which point it exits and releases its slot in the worker cap.
+func (srv *Server) worker(job *packetJob) {
+	defer atomic.AddInt32(&srv.workerCount, -1)
+
+	for job != nil {
+		srv.handleJob(job)
+
+		select {
+		case job = <-srv.queue:
+		case job = <-srv.backlog:
+		case <-time.After(srv.idleWorkerTimeout()):
+			return
+		}
+	}
+}
+
+// idleWorkerTimeout returns how long a worker waits on the queue for its next job before exiting,
+// falling back to defaultIdleWorkerTimeout when the Server was not given an explicit one.
+func (srv *Server) idleWorkerTimeout() time.Duration {
+	if srv.workerIdleTimeout > 0 {
+		return srv.workerIdleTimeout
+	}
+	return defaultIdleWorkerTimeout
+}
+
+// handleJob runs the handler for job, returns its buffer to the pool, and marks it done on wg.
+func (srv *Server) handleJob(job *packetJob) {
+	defer srv.wg.Done()
+	defer GetBufferPool().Put(job.buf)
+
+	if err := srv.doHandle(job.buf[:job.n], job.sourceAddr); err != nil {
+		log.Printf("DEBUG: handler error for %s: %v", job.sourceAddr, err)
+	}
+}
@@ -0,0 +1,68 @@
+package srcds
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSpawnOrQueueRespectsMaxIdleWorkers verifies spawnOrQueue stops starting new worker goroutines
+// once workerCount has reached maxIdleWorkers, falling back to the buffered backlog instead.
+func TestSpawnOrQueueRespectsMaxIdleWorkers(t *testing.T) {
+	srv := &Server{
+		queue:   make(chan *packetJob),
+		backlog: make(chan *packetJob, queueSize),
+	}
+	atomic.StoreInt32(&srv.workerCount, maxIdleWorkers)
+
+	job := &packetJob{}
+	srv.spawnOrQueue(job)
+
+	select {
+	case got := <-srv.backlog:
+		if got != job {
+			t.Fatal("backlog received a different job than was queued")
+		}
+	default:
+		t.Fatal("job was not placed on the backlog once the worker cap was reached")
+	}
+
+	if got := atomic.LoadInt32(&srv.workerCount); got != maxIdleWorkers {
+		t.Fatalf("workerCount = %d, want unchanged at %d", got, maxIdleWorkers)
+	}
+}
+
+// TestWorkerExitsAfterIdleTimeout verifies a worker releases its slot in the pool once it has sat idle
+// for its idle timeout with no further jobs to pick up.
+func TestWorkerExitsAfterIdleTimeout(t *testing.T) {
+	srv := &Server{
+		handler:           recordingHandler{},
+		queue:             make(chan *packetJob),
+		backlog:           make(chan *packetJob, queueSize),
+		workerIdleTimeout: 20 * time.Millisecond,
+	}
+	atomic.AddInt32(&srv.workerCount, 1)
+
+	job := &packetJob{
+		buf:        GetBufferPool().Get(),
+		sourceAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+	}
+	srv.wg.Add(1)
+
+	done := make(chan struct{})
+	go func() {
+		srv.worker(job)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("worker did not exit after sitting idle past idleWorkerTimeout")
+	}
+
+	if got := atomic.LoadInt32(&srv.workerCount); got != 0 {
+		t.Fatalf("workerCount = %d, want 0 after the idle worker exited", got)
+	}
+}